@@ -1,18 +1,27 @@
 package critbitgo
 
 import (
+	"bufio"
+	"bytes"
+	"encoding/gob"
+	"fmt"
+	"io"
 	"net"
+	"net/netip"
+	"reflect"
+	"strings"
 )
 
 // IP routing table.
 type Net struct {
-	trie *Trie
+	trie      *Trie
+	dualStack bool
 }
 
 // Associates value with `s`.
 // If `s` is not CIDR notation, returns an error.
 func (n *Net) AddCIDR(s string, value interface{}) error {
-	key, err := netCidrToKey(s)
+	key, err := n.cidrToKey(s)
 	if err != nil {
 		return err
 	}
@@ -22,7 +31,7 @@ func (n *Net) AddCIDR(s string, value interface{}) error {
 // Deletes the mapping for `s`.
 // If `s` is not CIDR notation or the mapping is not found, return false.
 func (n *Net) DeleteCIDR(s string) bool {
-	key, err := netCidrToKey(s)
+	key, err := n.cidrToKey(s)
 	if err != nil {
 		return false
 	}
@@ -32,7 +41,7 @@ func (n *Net) DeleteCIDR(s string) bool {
 // Returns the value to which `s` is mapped.
 // If `s` is not CIDR notation, returns an error.
 func (n *Net) GetCIDR(s string) (value interface{}, err error) {
-	key, err := netCidrToKey(s)
+	key, err := n.cidrToKey(s)
 	if err == nil {
 		if node := n.trie.search(key); node.external != nil {
 			value = node.external.value
@@ -44,17 +53,230 @@ func (n *Net) GetCIDR(s string) (value interface{}, err error) {
 // Returns the value by using the longest prefix matching.
 // If `s` is not CIDR notation, returns an error.
 func (n *Net) MatchCIDR(s string) (cidr string, value interface{}, err error) {
-	key, err := netCidrToKey(s)
+	key, err := n.cidrToKey(s)
 	if err != nil || n.trie.size == 0 {
 		return
 	}
 	if node := match(&n.trie.root, key, false); node != nil {
-		cidr = netKeyToCidr(node.external.key)
+		cidr = n.keyToCidr(node.external.key)
 		value = node.external.value
 	}
 	return
 }
 
+// Associates value with `s`. If adjacent CIDRs already mapped to an equal
+// value exist (e.g. 10.0.0.0/25 and 10.0.0.128/25 both holding "x"), they
+// are coalesced with the new entry into the shortest common supernet,
+// repeating up the tree for as long as the wider supernet's sibling also
+// matches. This keeps the trie minimal when building allow/deny lists
+// from individually-added ranges.
+// If `s` is not CIDR notation, returns an error.
+func (n *Net) AddCIDRMerged(s string, value interface{}) error {
+	_, ipnet, err := net.ParseCIDR(s)
+	if err != nil {
+		return err
+	}
+	ones, bits := ipnet.Mask.Size()
+	ip := ipnet.IP.Mask(ipnet.Mask)
+
+	for ones > 0 {
+		sibling := siblingCIDR(ip, ones)
+		v, err := n.GetCIDR(sibling)
+		if err != nil || v == nil || !reflect.DeepEqual(v, value) {
+			break
+		}
+		if !n.DeleteCIDR(sibling) {
+			break
+		}
+		ones--
+		ip = ip.Mask(net.CIDRMask(ones, bits))
+	}
+
+	addr, _ := netip.AddrFromSlice(ip)
+	return n.AddCIDR(netip.PrefixFrom(addr, ones).String(), value)
+}
+
+// Removes the range `s` from the table. Any mapping nested inside `s` is
+// dropped outright; every covering supernet is instead split into the
+// minimal set of CIDRs that cover what is left of it once `s` is
+// subtracted, keeping each supernet's original value. Returns the
+// replacement CIDRs added for split supernets, or nil if nothing needed
+// splitting. If `s` is not CIDR notation, returns nil.
+func (n *Net) SubtractCIDR(s string) []string {
+	key, err := n.cidrToKey(s)
+	if err != nil {
+		return nil
+	}
+	iplen := len(key) - 2
+	ones := int(key[iplen])
+
+	// A mapping fully nested inside `s` (including one that exactly
+	// matches `s`) is simply removed.
+	var nested []string
+	n.WalkPrefix(s, func(cidr string, _ interface{}) bool {
+		nested = append(nested, cidr)
+		return true
+	})
+	for _, cidr := range nested {
+		n.DeleteCIDR(cidr)
+	}
+
+	if n.trie.size == 0 {
+		return nil
+	}
+
+	// Every covering supernet left needs to be split around `s`. Matching
+	// is done against the raw key so the supernets' own mask bytes are
+	// compared in the same key space as `s` (important in a dual-stack
+	// table, where `key` may already be the folded v4-in-v6 form).
+	var matches []*node
+	matchAll(&n.trie.root, key, false, &matches)
+
+	// matchAll yields most-specific first. Two covering supernets can
+	// want to split the same mask length (e.g. a /8 and a nested /16
+	// both covering `s`); the deepest one owns that fragment, so once a
+	// mask length has been split by a more specific supernet, a wider one
+	// must not re-split (and overwrite) it.
+	claimed := make([]bool, ones)
+
+	var remaining []string
+	for _, m := range matches {
+		supernetKey, value := m.external.key, m.external.value
+		supernetOnes := int(supernetKey[iplen])
+
+		n.trie.Delete(supernetKey)
+		for i := supernetOnes; i < ones; i++ {
+			if claimed[i] {
+				continue
+			}
+			claimed[i] = true
+
+			frag := append(net.IP(nil), key[:iplen]...)
+			byteIdx, bitIdx := i/8, 7-uint(i%8)
+			frag[byteIdx] ^= 1 << bitIdx
+			frag = frag.Mask(net.CIDRMask(i+1, iplen*8))
+
+			cidr := n.keyToCidr(append(append(net.IP(nil), frag...), byte(i+1), 0xff))
+			n.AddCIDR(cidr, value)
+			remaining = append(remaining, cidr)
+		}
+	}
+	return remaining
+}
+
+// Returns the CIDR for the other half of the supernet that the `/ones`
+// network rooted at `ip` belongs to.
+func siblingCIDR(ip net.IP, ones int) string {
+	sibling := append(net.IP(nil), ip...)
+	byteIdx, bitIdx := (ones-1)/8, 7-uint((ones-1)%8)
+	sibling[byteIdx] ^= 1 << bitIdx
+	addr, _ := netip.AddrFromSlice(sibling)
+	return netip.PrefixFrom(addr, ones).String()
+}
+
+// Associates value with `prefix`. In dual-stack tables an IPv4 prefix is
+// stored in its v4-mapped IPv6 form, so it can be matched against both
+// IPv4 and IPv6 queries.
+func (n *Net) AddPrefix(prefix netip.Prefix, value interface{}) error {
+	return n.trie.Set(n.prefixToKey(prefix), value)
+}
+
+// Deletes the mapping for `prefix`.
+func (n *Net) DeletePrefix(prefix netip.Prefix) bool {
+	return n.trie.Delete(n.prefixToKey(prefix))
+}
+
+// Returns the value to which `prefix` is mapped.
+func (n *Net) GetPrefix(prefix netip.Prefix) (value interface{}) {
+	if node := n.trie.search(n.prefixToKey(prefix)); node.external != nil {
+		value = node.external.value
+	}
+	return
+}
+
+// Returns the value by using the longest prefix matching against `addr`.
+func (n *Net) MatchIP(addr netip.Addr) (prefix netip.Prefix, value interface{}) {
+	if n.trie.size == 0 {
+		return
+	}
+	key := n.addrToKey(addr)
+	if node := match(&n.trie.root, key, false); node != nil {
+		prefix = n.keyToPrefix(node.external.key)
+		value = node.external.value
+	}
+	return
+}
+
+// Returns every stored CIDR that contains the queried address/prefix,
+// ordered from most specific to least specific.
+// If `s` is not CIDR notation, returns an error.
+func (n *Net) MatchAllCIDR(s string) (cidrs []string, values []interface{}, err error) {
+	key, err := n.cidrToKey(s)
+	if err != nil || n.trie.size == 0 {
+		return
+	}
+	var matches []*node
+	matchAll(&n.trie.root, key, false, &matches)
+
+	cidrs = make([]string, len(matches))
+	values = make([]interface{}, len(matches))
+	for i, m := range matches {
+		cidrs[i] = n.keyToCidr(m.external.key)
+		values[i] = m.external.value
+	}
+	return
+}
+
+// Same traversal as match(), but instead of stopping at the first hit it
+// backtracks through every branch that can hold a covering prefix and
+// appends each one it finds to `results`.
+func matchAll(p *node, key []byte, backtracking bool, results *[]*node) {
+	if p.internal != nil {
+		var direction int
+		if p.internal.offset == len(key)-2 {
+			// selecting the larger side when comparing the mask
+			direction = 1
+		} else if backtracking {
+			direction = 0
+		} else {
+			direction = p.internal.direction(key)
+		}
+
+		matchAll(&p.internal.child[direction], key, backtracking, results)
+		if direction == 1 {
+			// search other node
+			matchAll(&p.internal.child[0], key, true, results)
+		}
+		return
+	}
+
+	nlen := len(p.external.key)
+	if nlen != len(key) {
+		return
+	}
+
+	// check mask
+	mask := p.external.key[nlen-2]
+	if mask > key[nlen-2] {
+		return
+	}
+
+	// compare both keys with mask
+	div := int(mask >> 3)
+	for i := 0; i < div; i++ {
+		if p.external.key[i] != key[i] {
+			return
+		}
+	}
+	if mod := uint(mask & 0x07); mod > 0 {
+		bit := 8 - mod
+		if p.external.key[div] != key[div]&(0xff>>bit<<bit) {
+			return
+		}
+	}
+	*results = append(*results, p)
+}
+
 func match(p *node, key []byte, backtracking bool) *node {
 	if p.internal != nil {
 		var direction int
@@ -104,6 +326,103 @@ func match(p *node, key []byte, backtracking bool) *node {
 	}
 }
 
+// Iterates over all CIDRs in the table in ascending prefix order, invoking
+// `fn` for each one. Iteration stops early if `fn` returns false.
+func (n *Net) Walk(fn func(cidr string, value interface{}) bool) {
+	if n.trie.size == 0 {
+		return
+	}
+	walk(&n.trie.root, func(e *external) bool {
+		return fn(n.keyToCidr(e.key), e.value)
+	})
+}
+
+// Iterates over the CIDRs contained within `s` in ascending prefix order,
+// invoking `fn` for each one. If `s` is not CIDR notation, returns an error.
+func (n *Net) WalkPrefix(s string, fn func(cidr string, value interface{}) bool) error {
+	key, err := n.cidrToKey(s)
+	if err != nil {
+		return err
+	}
+	if n.trie.size == 0 {
+		return nil
+	}
+	root := subtree(&n.trie.root, key, int(key[len(key)-2])>>3)
+	walk(root, func(e *external) bool {
+		if !cidrContains(key, e.key) {
+			return true
+		}
+		return fn(n.keyToCidr(e.key), e.value)
+	})
+	return nil
+}
+
+// Walks the subtree rooted at `p` in ascending order, invoking `fn` for every
+// external node. Returns false if `fn` stopped the walk early.
+func walk(p *node, fn func(e *external) bool) bool {
+	if p.internal != nil {
+		if !walk(&p.internal.child[0], fn) {
+			return false
+		}
+		return walk(&p.internal.child[1], fn)
+	}
+	return fn(p.external)
+}
+
+// Descends from `p` following the bits of `key`, stopping at the first
+// internal node whose offset reaches `bound`. Every stored key that shares
+// the first `bound` bytes of `key` lies below that node, so it roots the
+// subtree that can contain matches for a `bound`-byte prefix; keys below it
+// are not guaranteed to share those bytes.
+func subtree(p *node, key []byte, bound int) *node {
+	for p.internal != nil && p.internal.offset < bound {
+		p = &p.internal.child[p.internal.direction(key)]
+	}
+	return p
+}
+
+// Reports whether `key` falls within the prefix encoded by `query`.
+func cidrContains(query, key []byte) bool {
+	nlen := len(key)
+	if nlen != len(query) {
+		return false
+	}
+
+	qmask := query[nlen-2]
+	if key[nlen-2] < qmask {
+		return false
+	}
+
+	div := int(qmask >> 3)
+	for i := 0; i < div; i++ {
+		if key[i] != query[i] {
+			return false
+		}
+	}
+	if mod := uint(qmask & 0x07); mod > 0 {
+		bit := 8 - mod
+		if key[div]&(0xff>>bit<<bit) != query[div]&(0xff>>bit<<bit) {
+			return false
+		}
+	}
+	return true
+}
+
+// Returns an independent copy of the table. Mutating the clone never
+// affects the original, and vice versa; stored values are shared, not
+// deep-copied.
+func (n *Net) clone() *Net {
+	c := NewNetWithCapacity(n.trie.size)
+	c.dualStack = n.dualStack
+	if n.trie.size > 0 {
+		walk(&n.trie.root, func(e *external) bool {
+			c.trie.Set(e.key, e.value)
+			return true
+		})
+	}
+	return c
+}
+
 // Deletes all mappings
 func (n *Net) Clear() {
 	n.trie.Clear()
@@ -116,31 +435,212 @@ func (n *Net) Size() int {
 
 // Create IP routing table
 func NewNet() *Net {
-	return &Net{NewTrie()}
+	return &Net{trie: NewTrie()}
 }
 
 // Create IP routing table with the specified initial capacity.
 func NewNetWithCapacity(c int) *Net {
-	return &Net{NewTrieWithCapacity(c)}
+	return &Net{trie: NewTrieWithCapacity(c)}
 }
 
-func netCidrToKey(s string) ([]byte, error) {
+// Create an IP routing table that holds IPv4 and IPv6 routes side by side.
+// IPv4 entries are normalized to their RFC 2765 v4-mapped IPv6 form
+// (::ffff:0:0/96) on insert, so a single table can answer IPv4 queries
+// against IPv6-shaped keys and vice-versa.
+func NewNetDualStack() *Net {
+	return &Net{trie: NewTrie(), dualStack: true}
+}
+
+// Creates an IP routing table preloaded from `keys`/`values`. `keys` must
+// already be sorted in strictly ascending byte order (as produced by,
+// e.g., merging CIDR ranges up front); this is checked, and an error is
+// returned if it does not hold. This is a convenience for callers that
+// already have flat, pre-sorted route data on hand (e.g. a deserialized
+// GeoIP dump) so they don't need to rebuild it through repeated AddCIDR
+// calls; it carries no stronger complexity guarantee than AddCIDR does.
+func NewNetFromSorted(keys [][]byte, values []interface{}) (*Net, error) {
+	if len(keys) != len(values) {
+		return nil, fmt.Errorf("critbitgo: %d keys but %d values", len(keys), len(values))
+	}
+	for i := 1; i < len(keys); i++ {
+		if bytes.Compare(keys[i-1], keys[i]) >= 0 {
+			return nil, fmt.Errorf("critbitgo: keys not strictly sorted at index %d", i)
+		}
+	}
+
+	n := NewNetWithCapacity(len(keys))
+	for i, key := range keys {
+		if err := n.trie.Set(key, values[i]); err != nil {
+			return nil, err
+		}
+	}
+	return n, nil
+}
+
+// Streams CIDR routes from `r` into the table, one per line in the form
+// "<cidr>\t<payload>" (the payload and the preceding tab may be omitted).
+// `decodeValue` turns the raw payload bytes into the value to store, and
+// is called with a nil slice for lines without a payload. Reading is
+// streamed line-by-line so that GeoIP-sized route lists (hundreds of
+// thousands of prefixes) can be loaded without holding the whole file in
+// memory.
+func (n *Net) LoadCIDRs(r io.Reader, decodeValue func([]byte) (interface{}, error)) error {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if line == "" {
+			continue
+		}
+
+		cidr, payload := line, []byte(nil)
+		if i := strings.IndexByte(line, '\t'); i >= 0 {
+			cidr, payload = line[:i], []byte(line[i+1:])
+		}
+
+		value, err := decodeValue(payload)
+		if err != nil {
+			return err
+		}
+		if err := n.AddCIDR(cidr, value); err != nil {
+			return err
+		}
+	}
+	return scanner.Err()
+}
+
+// Serializes the table to a compact binary form that UnmarshalBinary can
+// load back. Stored values are encoded with encoding/gob, so any
+// non-builtin value type must be registered with gob.Register beforehand.
+func (n *Net) MarshalBinary() ([]byte, error) {
+	buf := new(bytes.Buffer)
+	enc := gob.NewEncoder(buf)
+	if err := enc.Encode(n.dualStack); err != nil {
+		return nil, err
+	}
+	if err := enc.Encode(n.trie.size); err != nil {
+		return nil, err
+	}
+	if n.trie.size == 0 {
+		return buf.Bytes(), nil
+	}
+
+	var encErr error
+	walk(&n.trie.root, func(e *external) bool {
+		if encErr = enc.Encode(e.key); encErr != nil {
+			return false
+		}
+		if encErr = enc.Encode(&e.value); encErr != nil {
+			return false
+		}
+		return true
+	})
+	if encErr != nil {
+		return nil, encErr
+	}
+	return buf.Bytes(), nil
+}
+
+// Replaces the table's contents with the routes encoded in `data` by a
+// prior call to MarshalBinary. As with MarshalBinary, any non-builtin
+// value type must be registered with gob.Register beforehand.
+func (n *Net) UnmarshalBinary(data []byte) error {
+	dec := gob.NewDecoder(bytes.NewReader(data))
+
+	var dualStack bool
+	if err := dec.Decode(&dualStack); err != nil {
+		return err
+	}
+	var size int
+	if err := dec.Decode(&size); err != nil {
+		return err
+	}
+
+	trie := NewTrieWithCapacity(size)
+	for i := 0; i < size; i++ {
+		var key []byte
+		var value interface{}
+		if err := dec.Decode(&key); err != nil {
+			return err
+		}
+		if err := dec.Decode(&value); err != nil {
+			return err
+		}
+		if err := trie.Set(key, value); err != nil {
+			return err
+		}
+	}
+
+	n.trie = trie
+	n.dualStack = dualStack
+	return nil
+}
+
+// v4InV6Prefix is the RFC 2765 v4-mapped prefix ::ffff:0:0/96 used to fold
+// IPv4 routes into a dual-stack (IPv6-shaped) table.
+var v4InV6Prefix = [12]byte{0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0xff, 0xff}
+
+func (n *Net) cidrToKey(s string) ([]byte, error) {
 	_, ipnet, err := net.ParseCIDR(s)
 	if err != nil {
 		return nil, err
 	}
-	ones, _ := ipnet.Mask.Size()
-	// +--------------+------+--------------+
-	// | ip address.. | mask | termination  |
-	// +--------------+------+--------------+
-	return append(append(ipnet.IP, byte(ones)), 0xff), nil
+	ones, bits := ipnet.Mask.Size()
+	return n.buildKey(ipnet.IP, ones, bits), nil
+}
+
+func (n *Net) prefixToKey(prefix netip.Prefix) []byte {
+	addr := prefix.Masked().Addr()
+	return n.buildKey(net.IP(addr.AsSlice()), prefix.Bits(), addr.BitLen())
+}
+
+func (n *Net) addrToKey(addr netip.Addr) []byte {
+	return n.buildKey(net.IP(addr.AsSlice()), addr.BitLen(), addr.BitLen())
+}
+
+// Lays out `ip` as a crit-bit key:
+//
+//	+--------------+------+--------------+
+//	| ip address.. | mask | termination  |
+//	+--------------+------+--------------+
+//
+// In dual-stack tables a 4-byte (IPv4) `ip` is folded into its v4-mapped
+// IPv6 form first, so every key in the table has the same length.
+func (n *Net) buildKey(ip net.IP, ones, bits int) []byte {
+	if n.dualStack && bits == 32 {
+		mapped := make(net.IP, 16)
+		copy(mapped[:12], v4InV6Prefix[:])
+		copy(mapped[12:], ip.To4())
+		ip, ones = mapped, ones+96
+	}
+	return append(append(append(net.IP{}, ip...), byte(ones)), 0xff)
+}
+
+// Renders `k` as a CIDR string. In dual-stack tables a v4-mapped key is
+// unfolded back to plain IPv4 notation first, so a caller sees the same
+// address family it inserted. Non-dual-stack tables never unfold, so a
+// genuine ::ffff:.../120 entry is reported as the IPv6 CIDR it is.
+func (n *Net) keyToCidr(k []byte) string {
+	return n.keyToPrefix(k).String()
+}
+
+// Same unfolding as keyToCidr, returning a netip.Prefix instead.
+func (n *Net) keyToPrefix(k []byte) netip.Prefix {
+	ip, ones := n.unmapKey(k)
+	addr, _ := netip.AddrFromSlice(ip)
+	return netip.PrefixFrom(addr, ones)
 }
 
-func netKeyToCidr(k []byte) string {
+// Splits `k` into its IP bytes and prefix length, unfolding a v4-mapped
+// IPv6 address back into its plain IPv4 form when `n` is a dual-stack
+// table. Reports the IPv6 form unchanged for genuine IPv6 keys and for
+// supernets wider than the /96 v4-mapped prefix itself, since those also
+// cover addresses outside the IPv4 range.
+func (n *Net) unmapKey(k []byte) (net.IP, int) {
 	iplen := len(k) - 2
-	ipnet := &net.IPNet{
-		IP:   net.IP(k[:iplen]),
-		Mask: net.CIDRMask(int(k[iplen]), iplen*8),
+	ip, ones := net.IP(k[:iplen]), int(k[iplen])
+	if !n.dualStack || len(ip) != 16 || ones < 96 || !bytes.Equal(ip[:12], v4InV6Prefix[:]) {
+		return ip, ones
 	}
-	return ipnet.String()
+	return append(net.IP(nil), ip[12:]...), ones - 96
 }
@@ -0,0 +1,118 @@
+package critbitgo
+
+import (
+	"sync"
+)
+
+// Concurrency-safe IP routing table. SafeNet wraps Net with a
+// sync.RWMutex so that reads (MatchCIDR, GetCIDR, Walk, ...) can proceed
+// concurrently while writes serialize against them and each other.
+type SafeNet struct {
+	mu  sync.RWMutex
+	net *Net
+}
+
+// Create a concurrency-safe IP routing table.
+func NewSafeNet() *SafeNet {
+	return &SafeNet{net: NewNet()}
+}
+
+// Create a concurrency-safe IP routing table that holds IPv4 and IPv6
+// routes side by side. See NewNetDualStack.
+func NewSafeNetDualStack() *SafeNet {
+	return &SafeNet{net: NewNetDualStack()}
+}
+
+// Associates value with `cidr`.
+// If `cidr` is not CIDR notation, returns an error.
+func (s *SafeNet) AddCIDR(cidr string, value interface{}) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.net.AddCIDR(cidr, value)
+}
+
+// Deletes the mapping for `cidr`.
+// If `cidr` is not CIDR notation or the mapping is not found, return false.
+func (s *SafeNet) DeleteCIDR(cidr string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.net.DeleteCIDR(cidr)
+}
+
+// Returns the value to which `cidr` is mapped.
+// If `cidr` is not CIDR notation, returns an error.
+func (s *SafeNet) GetCIDR(cidr string) (interface{}, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.net.GetCIDR(cidr)
+}
+
+// Returns the value by using the longest prefix matching.
+// If `cidr` is not CIDR notation, returns an error.
+func (s *SafeNet) MatchCIDR(cidr string) (string, interface{}, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.net.MatchCIDR(cidr)
+}
+
+// Returns every stored CIDR that contains the queried address/prefix,
+// ordered from most specific to least specific.
+// If `cidr` is not CIDR notation, returns an error.
+func (s *SafeNet) MatchAllCIDR(cidr string) ([]string, []interface{}, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.net.MatchAllCIDR(cidr)
+}
+
+// Iterates over all CIDRs in the table in ascending prefix order, invoking
+// `fn` for each one. Iteration stops early if `fn` returns false.
+func (s *SafeNet) Walk(fn func(cidr string, value interface{}) bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	s.net.Walk(fn)
+}
+
+// Iterates over the CIDRs contained within `cidr` in ascending prefix
+// order, invoking `fn` for each one. If `cidr` is not CIDR notation,
+// returns an error.
+func (s *SafeNet) WalkPrefix(cidr string, fn func(cidr string, value interface{}) bool) error {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.net.WalkPrefix(cidr, fn)
+}
+
+// Deletes all mappings
+func (s *SafeNet) Clear() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.net.Clear()
+}
+
+// Returns number of mappings
+func (s *SafeNet) Size() int {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.net.Size()
+}
+
+// Returns an independent copy of the table's current contents. Because
+// the snapshot is a plain *Net, readers can look up routes in it without
+// ever taking SafeNet's lock — but, being a plain *Net, nothing stops a
+// caller from mutating it. Don't, if you're relying on those lock-free
+// reads: treat the returned table as read-only.
+func (s *SafeNet) Snapshot() *Net {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.net.clone()
+}
+
+// Atomically swaps in `next` as the table's contents, e.g. a table built
+// offline with NewNetFromSorted or loaded with UnmarshalBinary. Swapping
+// in the new table only ever takes the write lock for the duration of the
+// pointer assignment, so reloading never blocks a reader for the whole
+// reload; Snapshots already handed out are unaffected.
+func (s *SafeNet) Replace(next *Net) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.net = next
+}
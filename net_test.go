@@ -0,0 +1,159 @@
+package critbitgo
+
+import (
+	"reflect"
+	"sort"
+	"testing"
+)
+
+func TestMatchAllCIDR_Ordering(t *testing.T) {
+	n := NewNet()
+	for cidr, value := range map[string]string{
+		"10.0.0.0/8":  "A",
+		"10.0.0.0/16": "B",
+		"10.0.0.0/24": "C",
+	} {
+		if err := n.AddCIDR(cidr, value); err != nil {
+			t.Fatalf("AddCIDR(%s): %v", cidr, err)
+		}
+	}
+
+	cidrs, values, err := n.MatchAllCIDR("10.0.0.5/32")
+	if err != nil {
+		t.Fatalf("MatchAllCIDR: %v", err)
+	}
+
+	wantCidrs := []string{"10.0.0.0/24", "10.0.0.0/16", "10.0.0.0/8"}
+	wantValues := []interface{}{"C", "B", "A"}
+	if !reflect.DeepEqual(cidrs, wantCidrs) {
+		t.Errorf("cidrs = %v, want %v (most specific first)", cidrs, wantCidrs)
+	}
+	if !reflect.DeepEqual(values, wantValues) {
+		t.Errorf("values = %v, want %v", values, wantValues)
+	}
+}
+
+func TestSubtractCIDR_NestedSupernets(t *testing.T) {
+	n := NewNet()
+	mustAdd(t, n, "10.0.0.0/8", "A")
+	mustAdd(t, n, "10.0.0.0/16", "B")
+
+	remaining := n.SubtractCIDR("10.0.5.0/24")
+	if len(remaining) == 0 {
+		t.Fatalf("SubtractCIDR returned no replacement fragments")
+	}
+
+	// The subtracted range itself should no longer match anything.
+	if cidr, _, _ := n.MatchCIDR("10.0.5.5/32"); cidr != "" {
+		t.Errorf("10.0.5.5/32 still matches %q after subtracting its /24", cidr)
+	}
+
+	// Still inside the more specific /16, but outside the subtracted /24:
+	// must keep the /16's value, not fall back to the /8's.
+	if _, value, _ := n.MatchCIDR("10.0.6.5/32"); value != "B" {
+		t.Errorf("10.0.6.5/32 matched %v, want the /16's value %q", value, "B")
+	}
+
+	// Outside the /16 entirely, still inside the /8.
+	if _, value, _ := n.MatchCIDR("10.1.5.5/32"); value != "A" {
+		t.Errorf("10.1.5.5/32 matched %v, want the /8's value %q", value, "A")
+	}
+}
+
+func TestSubtractCIDR_ExactMatch(t *testing.T) {
+	n := NewNet()
+	mustAdd(t, n, "10.0.0.0/24", "A")
+
+	if remaining := n.SubtractCIDR("10.0.0.0/24"); remaining != nil {
+		t.Errorf("SubtractCIDR on an exact match returned fragments: %v", remaining)
+	}
+	if cidr, _, _ := n.MatchCIDR("10.0.0.1/32"); cidr != "" {
+		t.Errorf("10.0.0.1/32 still matches %q after subtracting its exact /24", cidr)
+	}
+}
+
+func TestDualStack_RoundTrip(t *testing.T) {
+	n := NewNetDualStack()
+	mustAdd(t, n, "10.0.0.0/24", "x")
+
+	// The IPv4 route round-trips as IPv4, not as its folded v6 form.
+	cidr, value, err := n.MatchCIDR("10.0.0.5/32")
+	if err != nil {
+		t.Fatalf("MatchCIDR: %v", err)
+	}
+	if cidr != "10.0.0.0/24" || value != "x" {
+		t.Errorf("MatchCIDR(v4) = (%q, %v), want (\"10.0.0.0/24\", \"x\")", cidr, value)
+	}
+
+	// The same route is reachable through its v4-mapped IPv6 form.
+	cidr, value, err = n.MatchCIDR("::ffff:10.0.0.5/128")
+	if err != nil {
+		t.Fatalf("MatchCIDR(v6): %v", err)
+	}
+	if cidr != "10.0.0.0/24" || value != "x" {
+		t.Errorf("MatchCIDR(v6) = (%q, %v), want (\"10.0.0.0/24\", \"x\")", cidr, value)
+	}
+}
+
+func TestMatchCIDR_NonDualStackDoesNotUnmap(t *testing.T) {
+	n := NewNet()
+	mustAdd(t, n, "::ffff:1.2.3.0/120", "y")
+
+	cidr, value, err := n.MatchCIDR("::ffff:1.2.3.4/128")
+	if err != nil {
+		t.Fatalf("MatchCIDR: %v", err)
+	}
+	if cidr != "::ffff:1.2.3.0/120" || value != "y" {
+		t.Errorf("MatchCIDR = (%q, %v), want the untouched IPv6 CIDR", cidr, value)
+	}
+}
+
+func TestMarshalBinary_PreservesDualStack(t *testing.T) {
+	orig := NewNetDualStack()
+	mustAdd(t, orig, "10.0.0.0/24", "x")
+
+	data, err := orig.MarshalBinary()
+	if err != nil {
+		t.Fatalf("MarshalBinary: %v", err)
+	}
+
+	got := NewNet()
+	if err := got.UnmarshalBinary(data); err != nil {
+		t.Fatalf("UnmarshalBinary: %v", err)
+	}
+
+	// A v6-shaped query should still hit the v4 route, proving dualStack
+	// survived the round trip rather than reverting to a plain Net.
+	if _, value, _ := got.MatchCIDR("::ffff:10.0.0.5/128"); value != "x" {
+		t.Errorf("unmarshaled table lost dual-stack matching: got value %v", value)
+	}
+}
+
+func mustAdd(t *testing.T, n *Net, cidr string, value interface{}) {
+	t.Helper()
+	if err := n.AddCIDR(cidr, value); err != nil {
+		t.Fatalf("AddCIDR(%s): %v", cidr, err)
+	}
+}
+
+func TestWalk_AscendingOrder(t *testing.T) {
+	n := NewNet()
+	mustAdd(t, n, "10.0.1.0/24", "a")
+	mustAdd(t, n, "10.0.0.0/24", "b")
+	mustAdd(t, n, "10.0.2.0/24", "c")
+
+	var seen []string
+	n.Walk(func(cidr string, _ interface{}) bool {
+		seen = append(seen, cidr)
+		return true
+	})
+
+	sorted := append([]string(nil), seen...)
+	sort.Strings(sorted)
+	if !reflect.DeepEqual(seen, sorted) {
+		t.Errorf("Walk order = %v, want ascending %v", seen, sorted)
+	}
+	if len(seen) != 3 {
+		t.Errorf("Walk visited %d entries, want 3", len(seen))
+	}
+}